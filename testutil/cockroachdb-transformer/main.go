@@ -20,7 +20,9 @@ import (
 	"io"
 	"os"
 	"strconv"
+	"strings"
 	"text/template"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -36,11 +38,265 @@ type Spec struct {
 	// Replicas is the number of Deployment replicas
 	// Defaults to the REPLICAS env var, or 1
 	Replicas *int `yaml:"replicas""`
+
+	// Secure enables CockroachDB's secure mode: a ServiceAccount, RBAC rules
+	// for CSR-based node/client cert bootstrapping, and the matching
+	// --certs-dir start flags are added to the generated resources.
+	// Defaults to false (insecure mode).
+	Secure *bool `yaml:"secure""`
+
+	// ServiceAccountName is the name of the ServiceAccount used by the
+	// cert-bootstrapping init containers when Secure is true.
+	// Defaults to <name>-cockroachdb.
+	ServiceAccountName string `yaml:"serviceAccountName""`
+
+	// SelfSigner configures an in-cluster bootstrap Job and rotation CronJob
+	// that mint and renew a self-signed CA plus node and client certs,
+	// instead of requesting certs through the Kubernetes CSR API.
+	SelfSigner *SelfSigner `yaml:"selfSigner""`
+
+	// Image is the CockroachDB container image repository.
+	// Defaults to cockroachdb/cockroach.
+	Image string `yaml:"image""`
+
+	// Version is the CockroachDB image tag.
+	// Defaults to a current supported release.
+	Version string `yaml:"version""`
+
+	// Partition is the StatefulSet rollingUpdate partition: pods with an
+	// ordinal below this value are not updated, allowing a controlled,
+	// staged version upgrade.
+	// Defaults to 0 (update all pods).
+	Partition *int `yaml:"partition""`
+
+	// JoinList is the comma-separated "--join" addresses of every replica,
+	// computed from Replicas and Metadata.Name. It is not user-configurable.
+	JoinList string `yaml:"-"`
+
+	// Storage configures the volumeClaimTemplate used for each replica's
+	// data directory.
+	Storage *Storage `yaml:"storage""`
+
+	// Resources sets cpu/memory requests and limits on the cockroachdb
+	// container. Unset by default, matching upstream's own cockroach start
+	// defaults.
+	Resources *Resources `yaml:"resources""`
+
+	// Cache is the cockroach start --cache value, accepting either an
+	// absolute size like "2GiB" or a percentage like "25%".
+	Cache string `yaml:"cache""`
+
+	// MaxSQLMemory is the cockroach start --max-sql-memory value, accepting
+	// either an absolute size like "2GiB" or a percentage like "25%".
+	MaxSQLMemory string `yaml:"maxSqlMemory""`
+
+	// HostNetwork runs pods in the node's network namespace, part of the
+	// benchmark-grade performance configuration.
+	// Defaults to false.
+	HostNetwork *bool `yaml:"hostNetwork""`
+
+	// WALFailover enables --wal-failover=among-stores so a stalled store
+	// doesn't stall the whole node, part of the benchmark-grade performance
+	// configuration.
+	// Defaults to false.
+	WALFailover *bool `yaml:"walFailover""`
+
+	// Topology switches the generator from a single StatefulSet to one
+	// Deployment per entry, each pinned to a specific Kubernetes node via
+	// nodeSelector with its data on a hostPath volume. The entry's static IP
+	// is advertised via --advertise-addr and listed in hand-made Endpoints.
+	// Empty by default (StatefulSet mode).
+	Topology []TopologyNode `yaml:"topology""`
+
+	// HostPath is the host directory each topology Deployment's data volume
+	// is rooted at. Each Deployment gets its own subdirectory named after its
+	// TopologyNode.Name.
+	// Defaults to /mnt/data/<name>.
+	HostPath string `yaml:"hostPath""`
+
+	// TopologyJoinList is the comma-separated "--join" addresses of every
+	// topology entry's static IP. It is not user-configurable.
+	TopologyJoinList string `yaml:"-"`
+
+	// Availability configures the PodDisruptionBudget and anti-affinity
+	// policy.
+	Availability *Availability `yaml:"availability""`
+
+	// TopologySpreadConstraints passes user-supplied topologySpreadConstraints
+	// through to the pod spec verbatim, e.g. to spread evenly across zones.
+	TopologySpreadConstraints []map[string]interface{} `yaml:"topologySpreadConstraints""`
+
+	// TopologySpreadConstraintsYAML is TopologySpreadConstraints re-marshaled
+	// and indented for splicing into the pod spec. It is not
+	// user-configurable.
+	TopologySpreadConstraintsYAML string `yaml:"-"`
+}
+
+// Availability configures the PodDisruptionBudget and anti-affinity policy,
+// replacing the fixed minAvailable: 67% and preferred anti-affinity that
+// silently ignored replica counts above 3.
+type Availability struct {
+	// MinAvailable sets PodDisruptionBudget.spec.minAvailable, e.g. "67%" or
+	// "2". Mutually exclusive with MaxUnavailable.
+	// Defaults to "67%" if neither is set.
+	MinAvailable *string `yaml:"minAvailable""`
+
+	// MaxUnavailable sets PodDisruptionBudget.spec.maxUnavailable, e.g. "1".
+	// Mutually exclusive with MinAvailable.
+	MaxUnavailable *string `yaml:"maxUnavailable""`
+
+	// AntiAffinity selects the pod anti-affinity mode: "preferred" (default),
+	// "required", or "none".
+	AntiAffinity string `yaml:"antiAffinity""`
+
+	// TopologyKey is the anti-affinity topology domain, e.g.
+	// "topology.kubernetes.io/zone" for multi-zone clusters.
+	// Defaults to kubernetes.io/hostname.
+	TopologyKey string `yaml:"topologyKey""`
+}
+
+// TopologyNode pins a single CockroachDB instance to a specific Kubernetes
+// node and static IP, for bare-metal/colo operators who need instances
+// co-located with their disks and cannot rely on dynamic PV provisioning.
+type TopologyNode struct {
+	// Name suffixes this instance's Deployment name: <name>-<Name>.
+	Name string `yaml:"name""`
+
+	// NodeName is the Kubernetes node this instance is pinned to via
+	// nodeSelector.
+	NodeName string `yaml:"nodeName""`
+
+	// IP is the static IP this instance advertises and is reachable at.
+	IP string `yaml:"ip""`
+
+	// Locality is the --locality value, e.g. "region=eu,zone=waw-1".
+	Locality string `yaml:"locality""`
+}
+
+// Storage configures the StatefulSet's volumeClaimTemplate.
+type Storage struct {
+	// Size is the PVC capacity, e.g. "100Gi".
+	// Defaults to 1Gi.
+	Size string `yaml:"size""`
+
+	// StorageClassName selects a non-default StorageClass for the PVC.
+	StorageClassName string `yaml:"storageClassName""`
+
+	// AccessModes are the PVC access modes.
+	// Defaults to ["ReadWriteOnce"].
+	AccessModes []string `yaml:"accessModes""`
+}
+
+// Resources mirrors a corev1.ResourceRequirements, restricted to the cpu and
+// memory resources the cockroachdb container cares about.
+type Resources struct {
+	Requests *ResourceList `yaml:"requests""`
+	Limits   *ResourceList `yaml:"limits""`
+}
+
+// ResourceList is a cpu/memory pair, e.g. {cpu: "2", memory: "8Gi"}.
+type ResourceList struct {
+	CPU    string `yaml:"cpu""`
+	Memory string `yaml:"memory""`
+}
+
+// SelfSigner is the tls.certs.selfSigner configuration: it controls how long
+// the self-signed CA and leaf certs live, and how soon before expiry they are
+// rotated.
+type SelfSigner struct {
+	// Enabled turns on the self-signer bootstrap Job and rotation CronJob.
+	Enabled *bool `yaml:"enabled""`
+
+	// MinimumCertDuration is the shortest lifetime any leaf (node or client)
+	// cert may be issued for. Generation fails if NodeCertDuration or
+	// ClientCertDuration is shorter than this.
+	MinimumCertDuration Duration `yaml:"minimumCertDuration""`
+
+	// CACertDuration is how long the self-signed CA cert is valid for.
+	CACertDuration Duration `yaml:"caCertDuration""`
+	// CACertExpiryWindow is how long before the CA cert expires that the
+	// rotation CronJob re-issues it, keeping the old CA in the bundle for one
+	// full NodeCertDuration before removal.
+	CACertExpiryWindow Duration `yaml:"caCertExpiryWindow""`
+
+	// ClientCertDuration is how long issued client certs are valid for.
+	ClientCertDuration Duration `yaml:"clientCertDuration""`
+	// ClientCertExpiryWindow is how long before expiry that client certs are
+	// re-issued.
+	ClientCertExpiryWindow Duration `yaml:"clientCertExpiryWindow""`
+
+	// NodeCertDuration is how long issued node certs are valid for.
+	NodeCertDuration Duration `yaml:"nodeCertDuration""`
+	// NodeCertExpiryWindow is how long before expiry that node certs are
+	// re-issued.
+	NodeCertExpiryWindow Duration `yaml:"nodeCertExpiryWindow""`
+
+	// RotationSchedule is the CronJob schedule computed from the smallest
+	// expiry window. It is not user-configurable.
+	RotationSchedule string `yaml:"-"`
+}
+
+// Duration wraps time.Duration so it can be decoded from a YAML scalar such
+// as "8760h" or "15m".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	parsed, err := time.ParseDuration(value.Value)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %v", value.Value, err)
+	}
+	d.Duration = parsed
+	return nil
 }
 
 type Metadata struct {
 	// Name is the Deployment Resource and Container name
 	Name string `yaml:"name""`
+
+	// Namespace is the namespace the ServiceAccount subjects in the
+	// RoleBinding/ClusterRoleBinding are bound against. It must track
+	// whatever namespace the rest of the package is ultimately applied into.
+	// Defaults to "default".
+	Namespace string `yaml:"namespace""`
+}
+
+// boolVal dereferences a *bool, treating a nil pointer as false. A non-nil
+// pointer is otherwise always truthy in a template {{if}}, regardless of the
+// value it points to.
+func boolVal(b *bool) bool {
+	return b != nil && *b
+}
+
+// selfSignerEnabled reports whether the self-signer bootstrap Job and
+// rotation CronJob are in use, treating a nil SelfSigner as disabled.
+func selfSignerEnabled(ss *SelfSigner) bool {
+	return ss != nil && boolVal(ss.Enabled)
+}
+
+// parsePercent parses a "NN%" string into a 0-1 fraction. ok is false if s
+// doesn't have a "%" suffix or the number before it doesn't parse.
+func parsePercent(s string) (frac float64, ok bool) {
+	if !strings.HasSuffix(s, "%") {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil {
+		return 0, false
+	}
+	return v / 100, true
+}
+
+// minDuration returns the smallest of the given durations.
+func minDuration(ds ...time.Duration) time.Duration {
+	min := ds[0]
+	for _, d := range ds[1:] {
+		if d < min {
+			min = d
+		}
+	}
+	return min
 }
 
 func main() {
@@ -74,11 +330,175 @@ func main() {
 		api.Spec.Replicas = &r
 	}
 
+	// Default the Namespace field
+	if api.Metadata.Namespace == "" {
+		api.Metadata.Namespace = "default"
+	}
+
+	// Default the Secure field
+	if api.Spec.Secure == nil {
+		f := false
+		api.Spec.Secure = &f
+	}
+
+	// Default the ServiceAccountName field
+	if api.Spec.ServiceAccountName == "" {
+		api.Spec.ServiceAccountName = api.Metadata.Name + "-cockroachdb"
+	}
+
+	// Default the Image and Version fields
+	if api.Spec.Image == "" {
+		api.Spec.Image = "cockroachdb/cockroach"
+	}
+	if api.Spec.Version == "" {
+		api.Spec.Version = "v23.1.11"
+	}
+
+	// Default the Partition field
+	if api.Spec.Partition == nil {
+		p := 0
+		api.Spec.Partition = &p
+	}
+
+	// Default the Storage field
+	if api.Spec.Storage == nil {
+		api.Spec.Storage = &Storage{}
+	}
+	if api.Spec.Storage.Size == "" {
+		api.Spec.Storage.Size = "1Gi"
+	}
+	if len(api.Spec.Storage.AccessModes) == 0 {
+		api.Spec.Storage.AccessModes = []string{"ReadWriteOnce"}
+	}
+
+	// Default the HostNetwork and WALFailover fields
+	if api.Spec.HostNetwork == nil {
+		f := false
+		api.Spec.HostNetwork = &f
+	}
+	if api.Spec.WALFailover == nil {
+		f := false
+		api.Spec.WALFailover = &f
+	}
+
+	// Compute the --join list from every replica's pod DNS name
+	joinAddrs := make([]string, *api.Spec.Replicas)
+	for i := range joinAddrs {
+		joinAddrs[i] = fmt.Sprintf("%s-%d.%s", api.Metadata.Name, i, api.Metadata.Name)
+	}
+	api.Spec.JoinList = strings.Join(joinAddrs, ",")
+
+	// Default and validate the Availability field
+	if api.Spec.Availability == nil {
+		api.Spec.Availability = &Availability{}
+	}
+	av := api.Spec.Availability
+	if av.MinAvailable != nil && av.MaxUnavailable != nil {
+		fmt.Fprintf(os.Stderr, "availability.minAvailable and availability.maxUnavailable are mutually exclusive\n")
+		os.Exit(1)
+	}
+	if av.MinAvailable == nil && av.MaxUnavailable == nil {
+		m := "67%"
+		av.MinAvailable = &m
+	}
+	if av.AntiAffinity == "" {
+		av.AntiAffinity = "preferred"
+	}
+	switch av.AntiAffinity {
+	case "preferred", "required", "none":
+	default:
+		fmt.Fprintf(os.Stderr, "availability.antiAffinity must be one of preferred, required, none, got %q\n", av.AntiAffinity)
+		os.Exit(1)
+	}
+	if av.TopologyKey == "" {
+		av.TopologyKey = "kubernetes.io/hostname"
+	}
+	// In topology mode Replicas is an unrelated, always-defaulted field; the
+	// pod count the PDB actually protects is the number of topology entries.
+	podCount := *api.Spec.Replicas
+	if len(api.Spec.Topology) > 0 {
+		podCount = len(api.Spec.Topology)
+	}
+	if av.MinAvailable != nil {
+		if frac, ok := parsePercent(*av.MinAvailable); ok {
+			if float64(podCount)*(1-frac) < 1 {
+				fmt.Fprintf(os.Stderr, "warning: replicas=%d with availability.minAvailable=%s allows 0 pods to be disrupted\n", podCount, *av.MinAvailable)
+			}
+		}
+	}
+
+	// Re-marshal TopologySpreadConstraints for splicing into the pod spec
+	if len(api.Spec.TopologySpreadConstraints) > 0 {
+		b, err := yaml.Marshal(api.Spec.TopologySpreadConstraints)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		lines := strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+		for i, line := range lines {
+			lines[i] = "      " + line
+		}
+		api.Spec.TopologySpreadConstraintsYAML = strings.Join(lines, "\n")
+	}
+
+	// Default the HostPath field and compute the topology --join list
+	if len(api.Spec.Topology) > 0 {
+		// Secure mode's cert provisioning (CSR init containers or the
+		// self-signer) is only wired into the StatefulSet path; topology
+		// Deployments have nowhere to mount the resulting certs yet.
+		if boolVal(api.Spec.Secure) {
+			fmt.Fprintf(os.Stderr, "secure: true is not yet supported together with topology\n")
+			os.Exit(1)
+		}
+		if api.Spec.HostPath == "" {
+			api.Spec.HostPath = "/mnt/data/" + api.Metadata.Name
+		}
+		ips := make([]string, len(api.Spec.Topology))
+		for i, n := range api.Spec.Topology {
+			ips[i] = n.IP
+		}
+		api.Spec.TopologyJoinList = strings.Join(ips, ",")
+	}
+
+	// Validate the SelfSigner field and compute its rotation schedule
+	if ss := api.Spec.SelfSigner; ss != nil && boolVal(ss.Enabled) {
+		if !boolVal(api.Spec.Secure) {
+			fmt.Fprintf(os.Stderr, "selfSigner.enabled requires secure: true\n")
+			os.Exit(1)
+		}
+		if ss.NodeCertDuration.Duration < ss.MinimumCertDuration.Duration {
+			fmt.Fprintf(os.Stderr, "selfSigner.nodeCertDuration must be >= selfSigner.minimumCertDuration\n")
+			os.Exit(1)
+		}
+		if ss.ClientCertDuration.Duration < ss.MinimumCertDuration.Duration {
+			fmt.Fprintf(os.Stderr, "selfSigner.clientCertDuration must be >= selfSigner.minimumCertDuration\n")
+			os.Exit(1)
+		}
+		if ss.CACertExpiryWindow.Duration >= ss.CACertDuration.Duration {
+			fmt.Fprintf(os.Stderr, "selfSigner.caCertExpiryWindow must be less than selfSigner.caCertDuration\n")
+			os.Exit(1)
+		}
+		if ss.NodeCertExpiryWindow.Duration >= ss.NodeCertDuration.Duration {
+			fmt.Fprintf(os.Stderr, "selfSigner.nodeCertExpiryWindow must be less than selfSigner.nodeCertDuration\n")
+			os.Exit(1)
+		}
+		if ss.ClientCertExpiryWindow.Duration >= ss.ClientCertDuration.Duration {
+			fmt.Fprintf(os.Stderr, "selfSigner.clientCertExpiryWindow must be less than selfSigner.clientCertDuration\n")
+			os.Exit(1)
+		}
+
+		window := minDuration(ss.CACertExpiryWindow.Duration, ss.NodeCertExpiryWindow.Duration, ss.ClientCertExpiryWindow.Duration)
+		ss.RotationSchedule = fmt.Sprintf("@every %s", window)
+	}
+
 	// Define the template.
 	// Disable the duck-commands for this generated Resource so that users don't override
 	// the generated values.
 	// Execute the template
-	t := template.Must(template.New("deployment").Parse(t))
+	t := template.Must(template.New("deployment").Funcs(template.FuncMap{
+		"boolVal":           boolVal,
+		"selfSignerEnabled": selfSignerEnabled,
+	}).Parse(t))
 	if err := t.Execute(os.Stdout, api); err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
@@ -144,10 +564,38 @@ spec:
     targetPort: 8080
     name: http
   clusterIP: None
+{{ if not .Spec.Topology }}
   selector:
     app: {{ .Metadata.Name }}-cockroachdb
+{{ end }}
+{{ if .Spec.Topology }}
 ---
-apiVersion: policy/v1beta1
+apiVersion: v1
+kind: Endpoints
+metadata:
+  # Topology mode pins each instance to a static IP rather than a
+  # dynamically-scheduled pod, so the headless Service above carries no
+  # selector: these Endpoints are maintained by hand instead.
+  name: {{ .Metadata.Name }}
+  labels:
+    app: {{ .Metadata.Name }}-cockroachdb
+  annotations:
+    kpt.dev/kio/path: null
+    kpt.dev/kio/index: null
+subsets:
+- addresses:
+{{ range .Spec.Topology }}
+  - ip: {{ .IP }}
+    hostname: {{ $.Metadata.Name }}-{{ .Name }}
+{{ end }}
+  ports:
+  - port: 26257
+    name: grpc
+  - port: 8080
+    name: http
+{{ end }}
+---
+apiVersion: policy/v1
 kind: PodDisruptionBudget
 metadata:
   name: cockroachdb-budget
@@ -160,7 +608,188 @@ spec:
   selector:
     matchLabels:
       app: {{ .Metadata.Name }}-cockroachdb
-  minAvailable: 67%
+{{ if .Spec.Availability.MinAvailable }}
+  minAvailable: {{ .Spec.Availability.MinAvailable }}
+{{ end }}
+{{ if .Spec.Availability.MaxUnavailable }}
+  maxUnavailable: {{ .Spec.Availability.MaxUnavailable }}
+{{ end }}
+{{ if boolVal .Spec.Secure }}
+---
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: {{ .Spec.ServiceAccountName }}
+  labels:
+    app: {{ .Metadata.Name }}-cockroachdb
+  annotations:
+    kpt.dev/kio/path: null
+    kpt.dev/kio/index: null
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  # Grants the init containers (and, when SelfSigner is enabled, the
+  # self-signer Job/CronJob) permission to create, read and rotate the
+  # Secrets holding the node and client certs.
+  name: {{ .Metadata.Name }}-cert-requester
+  labels:
+    app: {{ .Metadata.Name }}-cockroachdb
+  annotations:
+    kpt.dev/kio/path: null
+    kpt.dev/kio/index: null
+rules:
+- apiGroups:
+  - ""
+  resources:
+  - secrets
+  verbs:
+  - create
+  - get
+  - update
+  - patch
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: {{ .Metadata.Name }}-cert-requester
+  labels:
+    app: {{ .Metadata.Name }}-cockroachdb
+  annotations:
+    kpt.dev/kio/path: null
+    kpt.dev/kio/index: null
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: {{ .Metadata.Name }}-cert-requester
+subjects:
+- kind: ServiceAccount
+  name: {{ .Spec.ServiceAccountName }}
+  namespace: {{ .Metadata.Namespace }}
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  # Grants permission to create and watch CertificateSigningRequests, which
+  # is cluster-scoped in Kubernetes.
+  name: {{ .Metadata.Name }}-csr-approver
+  labels:
+    app: {{ .Metadata.Name }}-cockroachdb
+  annotations:
+    kpt.dev/kio/path: null
+    kpt.dev/kio/index: null
+rules:
+- apiGroups:
+  - certificates.k8s.io
+  resources:
+  - certificatesigningrequests
+  verbs:
+  - create
+  - get
+  - watch
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: {{ .Metadata.Name }}-csr-approver
+  labels:
+    app: {{ .Metadata.Name }}-cockroachdb
+  annotations:
+    kpt.dev/kio/path: null
+    kpt.dev/kio/index: null
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: ClusterRole
+  name: {{ .Metadata.Name }}-csr-approver
+subjects:
+- kind: ServiceAccount
+  name: {{ .Spec.ServiceAccountName }}
+  namespace: {{ .Metadata.Namespace }}
+{{ end }}
+{{ if .Spec.SelfSigner }}{{ if boolVal .Spec.SelfSigner.Enabled }}
+---
+apiVersion: batch/v1
+kind: Job
+metadata:
+  # Mints the self-signed CA and the initial node/client leaf certs. Safe to
+  # re-run: each step is a no-op if its Secret already exists.
+  name: {{ .Metadata.Name }}-self-signer-init
+  labels:
+    app: {{ .Metadata.Name }}-cockroachdb
+  annotations:
+    kpt.dev/kio/path: null
+    kpt.dev/kio/index: null
+spec:
+  template:
+    metadata:
+      labels:
+        app: {{ .Metadata.Name }}-cockroachdb
+    spec:
+      serviceAccountName: {{ .Spec.ServiceAccountName }}
+      restartPolicy: OnFailure
+      containers:
+      - name: self-signer-init
+        image: cockroachlabs/self-signer-cert:0.1
+        imagePullPolicy: IfNotPresent
+        command:
+        - "/bin/ash"
+        - "-ecx"
+        - |
+          /self-signer bootstrap -namespace=${POD_NAMESPACE} \
+            -ca-secret={{ .Metadata.Name }}-ca -ca-duration={{ .Spec.SelfSigner.CACertDuration }} \
+            -node-secret={{ .Metadata.Name }}-node -node-duration={{ .Spec.SelfSigner.NodeCertDuration }} \
+            -node-addresses={{ .Metadata.Name }},{{ .Metadata.Name }}-public,{{ .Metadata.Name }}.${POD_NAMESPACE}.svc.cluster.local,*.{{ .Metadata.Name }}.${POD_NAMESPACE}.svc.cluster.local \
+            -client-secret={{ .Metadata.Name }}-client-root -client-duration={{ .Spec.SelfSigner.ClientCertDuration }} -client-user=root
+        env:
+        - name: POD_NAMESPACE
+          valueFrom:
+            fieldRef:
+              fieldPath: metadata.namespace
+---
+apiVersion: batch/v1
+kind: CronJob
+metadata:
+  # Re-issues the CA and any leaf cert whose remaining validity has dropped
+  # below its expiry window. The schedule is derived from the smallest of the
+  # configured expiry windows.
+  name: {{ .Metadata.Name }}-self-signer-rotate
+  labels:
+    app: {{ .Metadata.Name }}-cockroachdb
+  annotations:
+    kpt.dev/kio/path: null
+    kpt.dev/kio/index: null
+spec:
+  schedule: "{{ .Spec.SelfSigner.RotationSchedule }}"
+  concurrencyPolicy: Forbid
+  jobTemplate:
+    spec:
+      template:
+        metadata:
+          labels:
+            app: {{ .Metadata.Name }}-cockroachdb
+        spec:
+          serviceAccountName: {{ .Spec.ServiceAccountName }}
+          restartPolicy: OnFailure
+          containers:
+          - name: self-signer-rotate
+            image: cockroachlabs/self-signer-cert:0.1
+            imagePullPolicy: IfNotPresent
+            command:
+            - "/bin/ash"
+            - "-ecx"
+            - |
+              /self-signer rotate -namespace=${POD_NAMESPACE} \
+                -ca-secret={{ .Metadata.Name }}-ca -ca-duration={{ .Spec.SelfSigner.CACertDuration }} -ca-expiry-window={{ .Spec.SelfSigner.CACertExpiryWindow }} \
+                -node-secret={{ .Metadata.Name }}-node -node-duration={{ .Spec.SelfSigner.NodeCertDuration }} -node-expiry-window={{ .Spec.SelfSigner.NodeCertExpiryWindow }} \
+                -client-secret={{ .Metadata.Name }}-client-root -client-duration={{ .Spec.SelfSigner.ClientCertDuration }} -client-expiry-window={{ .Spec.SelfSigner.ClientCertExpiryWindow }} \
+                -keep-old-ca-for={{ .Spec.SelfSigner.NodeCertDuration }}
+            env:
+            - name: POD_NAMESPACE
+              valueFrom:
+                fieldRef:
+                  fieldPath: metadata.namespace
+{{ end }}{{ end }}
+{{ if not .Spec.Topology }}
 ---
 apiVersion: apps/v1  #  for k8s versions before 1.9.0 use apps/v1beta2  and before 1.8.0 use extensions/v1beta1
 kind: StatefulSet
@@ -181,39 +810,93 @@ spec:
   selector:
     matchLabels:
       app: {{ .Metadata.Name }}-cockroachdb
+  # RollingUpdate with a partition lets operators stage a version upgrade:
+  # bump Spec.Version, then lower Spec.Partition one ordinal at a time to
+  # roll pods onto the new image under close watch.
+  updateStrategy:
+    type: RollingUpdate
+    rollingUpdate:
+      partition: {{ .Spec.Partition }}
   template:
     metadata:
       labels:
         app: {{ .Metadata.Name }}-cockroachdb
     spec:
+{{ if boolVal .Spec.Secure }}
+      serviceAccountName: {{ .Spec.ServiceAccountName }}
+{{ end }}
+{{ if boolVal .Spec.HostNetwork }}
+      # Running in the host's network namespace removes a layer of packet
+      # processing, part of the benchmark-grade performance configuration.
+      hostNetwork: true
+      dnsPolicy: ClusterFirstWithHostNet
+{{ end }}
+{{ if and (boolVal .Spec.Secure) (not (selfSignerEnabled .Spec.SelfSigner)) }}
       # Init containers are run only once in the lifetime of a pod, before
       # it's started up for the first time. It has to exit successfully
       # before the pod's main containers are allowed to start.
-      # This particular init container does a DNS lookup for other pods in
-      # the set to help determine whether or not a cluster already exists.
-      # If any other pods exist, it creates a file in the cockroach-data
-      # directory to pass that information along to the primary container that
-      # has to decide what command-line flags to use when starting CockroachDB.
-      # This only matters when a pod's persistent volume is empty - if it has
-      # data from a previous execution, that data will always be used.
-      #
-      # If your Kubernetes cluster uses a custom DNS domain, you will have
-      # to add an additional arg to this pod: "-domain=<your-custom-domain>"
+      # Only used when requesting certs through the Kubernetes CSR API; when
+      # SelfSigner is enabled the certs volume below is populated directly
+      # from its Secrets instead.
       initContainers:
-      - name: bootstrap
-        image: cockroachdb/cockroach-k8s-init:0.1
+      - name: request-cert
+        image: cockroachdb/cockroach-k8s-request-cert:0.4
         imagePullPolicy: IfNotPresent
-        args:
-        - "-on-start=/on-start.sh"
-        - "-service=cockroachdb"
+        # Requests a node cert from the Kubernetes CSR API, covering every
+        # address this pod may be reached at, and stores it under
+        # /cockroach-certs for the main container to mount.
+        command:
+        - "/bin/ash"
+        - "-ecx"
+        - |
+          /request-cert -namespace=${POD_NAMESPACE} -certs-dir=/cockroach-certs \
+            -type=node -addresses=localhost,127.0.0.1,${POD_IP},$(hostname -f),{{ .Metadata.Name }}-public,{{ .Metadata.Name }}-public.${POD_NAMESPACE},{{ .Metadata.Name }}-public.${POD_NAMESPACE}.svc.cluster.local \
+            -symlink-ca-from=/var/run/secrets/kubernetes.io/serviceaccount/ca.crt
         env:
+        - name: POD_IP
+          valueFrom:
+            fieldRef:
+              fieldPath: status.podIP
         - name: POD_NAMESPACE
           valueFrom:
             fieldRef:
               fieldPath: metadata.namespace
         volumeMounts:
-        - name: datadir
-          mountPath: "/cockroach/cockroach-data"
+        - name: certs
+          mountPath: /cockroach-certs
+      - name: request-client-cert
+        image: cockroachdb/cockroach-k8s-request-cert:0.4
+        imagePullPolicy: IfNotPresent
+        # Requests the root client cert used by cockroach sql from within the
+        # pod, stored alongside the node cert.
+        command:
+        - "/bin/ash"
+        - "-ecx"
+        - |
+          /request-cert -namespace=${POD_NAMESPACE} -certs-dir=/cockroach-certs -type=client -user=root \
+            -symlink-ca-from=/var/run/secrets/kubernetes.io/serviceaccount/ca.crt
+        env:
+        - name: POD_NAMESPACE
+          valueFrom:
+            fieldRef:
+              fieldPath: metadata.namespace
+        volumeMounts:
+        - name: certs
+          mountPath: /cockroach-certs
+{{ end }}
+{{ if eq .Spec.Availability.AntiAffinity "required" }}
+      affinity:
+        podAntiAffinity:
+          requiredDuringSchedulingIgnoredDuringExecution:
+          - labelSelector:
+              matchExpressions:
+              - key: app
+                operator: In
+                values:
+                - {{ .Metadata.Name }}-cockroachdb
+            topologyKey: {{ .Spec.Availability.TopologyKey }}
+{{ else if eq .Spec.Availability.AntiAffinity "none" }}
+{{ else }}
       affinity:
         podAntiAffinity:
           preferredDuringSchedulingIgnoredDuringExecution:
@@ -224,11 +907,16 @@ spec:
                 - key: app
                   operator: In
                   values:
-                  - cockroachdb
-              topologyKey: kubernetes.io/hostname
+                  - {{ .Metadata.Name }}-cockroachdb
+              topologyKey: {{ .Spec.Availability.TopologyKey }}
+{{ end }}
+{{ if .Spec.TopologySpreadConstraintsYAML }}
+      topologySpreadConstraints:
+{{ .Spec.TopologySpreadConstraintsYAML }}
+{{ end }}
       containers:
       - name: cockroachdb
-        image: cockroachdb/cockroach:v1.1.0
+        image: {{ .Spec.Image }}:{{ .Spec.Version }}
         imagePullPolicy: IfNotPresent
         ports:
         - containerPort: 26257
@@ -238,28 +926,56 @@ spec:
         volumeMounts:
         - name: datadir
           mountPath: /cockroach/cockroach-data
+{{ if boolVal .Spec.Secure }}
+        - name: certs
+          mountPath: /cockroach/cockroach-certs
+{{ end }}
+{{ if .Spec.Resources }}
+        resources:
+{{ if .Spec.Resources.Requests }}
+          requests:
+{{ if .Spec.Resources.Requests.CPU }}
+            cpu: {{ .Spec.Resources.Requests.CPU }}
+{{ end }}
+{{ if .Spec.Resources.Requests.Memory }}
+            memory: {{ .Spec.Resources.Requests.Memory }}
+{{ end }}
+{{ end }}
+{{ if .Spec.Resources.Limits }}
+          limits:
+{{ if .Spec.Resources.Limits.CPU }}
+            cpu: {{ .Spec.Resources.Limits.CPU }}
+{{ end }}
+{{ if .Spec.Resources.Limits.Memory }}
+            memory: {{ .Spec.Resources.Limits.Memory }}
+{{ end }}
+{{ end }}
+{{ end }}
         command:
           - "/bin/bash"
           - "-ecx"
           - |
             # The use of qualified ` + "`hostname -f`" + ` is crucial:
             # Other nodes aren't able to look up the unqualified hostname.
-            CRARGS=("start" "--logtostderr" "--insecure" "--host" "$(hostname -f)" "--http-host" "0.0.0.0")
-            # We only want to initialize a new cluster (by omitting the join flag)
-            # if we're sure that we're the first node (i.e. index 0) and that
-            # there aren't any other nodes running as part of the cluster that
-            # this is supposed to be a part of (which indicates that a cluster
-            # already exists and we should make sure not to create a new one).
-            # It's fine to run without --join on a restart if there aren't any
-            # other nodes.
-            if [ ! "$(hostname)" == "cockroachdb-0" ] || \
-               [ -e "/cockroach/cockroach-data/cluster_exists_marker" ]
-            then
-              # We don't join cockroachdb in order to avoid a node attempting
-              # to join itself, which currently doesn't work
-              # (https://github.com/cockroachdb/cockroach/issues/9625).
-              CRARGS+=("--join" "cockroachdb-public")
-            fi
+            # --join lists every replica explicitly; unlike older CockroachDB
+            # releases a node no longer infers cluster membership from its
+            # ordinal, so the cluster must be created separately via the
+            # {{ .Metadata.Name }}-init Job.
+            CRARGS=("start" "--logtostderr" "--host" "$(hostname -f)" "--http-host" "0.0.0.0" "--join" "{{ .Spec.JoinList }}")
+{{ if boolVal .Spec.Secure }}
+            CRARGS+=("--certs-dir=/cockroach/cockroach-certs")
+{{ else }}
+            CRARGS+=("--insecure")
+{{ end }}
+{{ if .Spec.Cache }}
+            CRARGS+=("--cache={{ .Spec.Cache }}")
+{{ end }}
+{{ if .Spec.MaxSQLMemory }}
+            CRARGS+=("--max-sql-memory={{ .Spec.MaxSQLMemory }}")
+{{ end }}
+{{ if boolVal .Spec.WALFailover }}
+            CRARGS+=("--wal-failover=among-stores")
+{{ end }}
             exec /cockroach/cockroach ${CRARGS[*]}
       # No pre-stop hook is required, a SIGTERM plus some time is all that's
       # needed for graceful shutdown of a node.
@@ -268,13 +984,207 @@ spec:
       - name: datadir
         persistentVolumeClaim:
           claimName: datadir
+{{ if boolVal .Spec.Secure }}
+{{ if selfSignerEnabled .Spec.SelfSigner }}
+      - name: certs
+        # Populated directly from the self-signer's Secrets rather than
+        # requested through the Kubernetes CSR API.
+        projected:
+          sources:
+          - secret:
+              name: {{ .Metadata.Name }}-ca
+              items:
+              - key: ca.crt
+                path: ca.crt
+          - secret:
+              name: {{ .Metadata.Name }}-node
+              items:
+              - key: node.crt
+                path: node.crt
+              - key: node.key
+                path: node.key
+          - secret:
+              name: {{ .Metadata.Name }}-client-root
+              items:
+              - key: client.root.crt
+                path: client.root.crt
+              - key: client.root.key
+                path: client.root.key
+{{ else }}
+      - name: certs
+        emptyDir: {}
+{{ end }}
+{{ end }}
   volumeClaimTemplates:
   - metadata:
       name: datadir
     spec:
       accessModes:
-        - "ReadWriteOnce"
+{{ range .Spec.Storage.AccessModes }}
+        - "{{ . }}"
+{{ end }}
+{{ if .Spec.Storage.StorageClassName }}
+      storageClassName: {{ .Spec.Storage.StorageClassName }}
+{{ end }}
       resources:
         requests:
-          storage: 1Gi
-`
\ No newline at end of file
+          storage: {{ .Spec.Storage.Size }}
+---
+apiVersion: batch/v1
+kind: Job
+metadata:
+  # Runs exactly once against a freshly started StatefulSet to create the
+  # cluster. CockroachDB no longer bootstraps a cluster implicitly on the
+  # first pod's ordinal, so this Job must run ` + "`cockroach init`" + ` before the
+  # cluster is usable.
+  name: {{ .Metadata.Name }}-init
+  labels:
+    app: {{ .Metadata.Name }}-cockroachdb
+  annotations:
+    kpt.dev/kio/path: null
+    kpt.dev/kio/index: null
+spec:
+  template:
+    metadata:
+      labels:
+        app: {{ .Metadata.Name }}-cockroachdb
+    spec:
+{{ if boolVal .Spec.Secure }}
+      serviceAccountName: {{ .Spec.ServiceAccountName }}
+{{ end }}
+      initContainers:
+      - name: wait-for-dns
+        image: {{ .Spec.Image }}:{{ .Spec.Version }}
+        imagePullPolicy: IfNotPresent
+        command:
+        - "/bin/bash"
+        - "-ecx"
+        - |
+          until host {{ .Metadata.Name }}-0.{{ .Metadata.Name }}; do sleep 1; done
+{{ if and (boolVal .Spec.Secure) (not (selfSignerEnabled .Spec.SelfSigner)) }}
+      - name: request-client-cert
+        image: cockroachdb/cockroach-k8s-request-cert:0.4
+        imagePullPolicy: IfNotPresent
+        command:
+        - "/bin/ash"
+        - "-ecx"
+        - |
+          /request-cert -namespace=${POD_NAMESPACE} -certs-dir=/cockroach-certs -type=client -user=root \
+            -symlink-ca-from=/var/run/secrets/kubernetes.io/serviceaccount/ca.crt
+        env:
+        - name: POD_NAMESPACE
+          valueFrom:
+            fieldRef:
+              fieldPath: metadata.namespace
+        volumeMounts:
+        - name: certs
+          mountPath: /cockroach-certs
+{{ end }}
+      containers:
+      - name: cluster-init
+        image: {{ .Spec.Image }}:{{ .Spec.Version }}
+        imagePullPolicy: IfNotPresent
+        command:
+        - "/bin/bash"
+        - "-ecx"
+        - |
+{{ if boolVal .Spec.Secure }}
+          cockroach init --certs-dir=/cockroach-certs --host={{ .Metadata.Name }}-0.{{ .Metadata.Name }}
+{{ else }}
+          cockroach init --insecure --host={{ .Metadata.Name }}-0.{{ .Metadata.Name }}
+{{ end }}
+{{ if boolVal .Spec.Secure }}
+        volumeMounts:
+        - name: certs
+          mountPath: /cockroach-certs
+{{ end }}
+      restartPolicy: Never
+{{ if boolVal .Spec.Secure }}
+      volumes:
+{{ if selfSignerEnabled .Spec.SelfSigner }}
+      - name: certs
+        projected:
+          sources:
+          - secret:
+              name: {{ .Metadata.Name }}-ca
+              items:
+              - key: ca.crt
+                path: ca.crt
+          - secret:
+              name: {{ .Metadata.Name }}-client-root
+              items:
+              - key: client.root.crt
+                path: client.root.crt
+              - key: client.root.key
+                path: client.root.key
+{{ else }}
+      - name: certs
+        emptyDir: {}
+{{ end }}
+{{ end }}
+{{ end }}
+{{ range .Spec.Topology }}
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  # Topology mode pins this instance to {{ .NodeName }} with a hostPath
+  # volume instead of a dynamically-provisioned PVC, so it always comes back
+  # up on the same node with the same data.
+  name: {{ $.Metadata.Name }}-{{ .Name }}
+  labels:
+    app: {{ $.Metadata.Name }}-cockroachdb
+  annotations:
+    kpt.dev/kio/path: null
+    kpt.dev/kio/index: null
+spec:
+  replicas: 1
+  selector:
+    matchLabels:
+      app: {{ $.Metadata.Name }}-cockroachdb
+      topology: {{ .Name }}
+  template:
+    metadata:
+      labels:
+        app: {{ $.Metadata.Name }}-cockroachdb
+        topology: {{ .Name }}
+    spec:
+      nodeSelector:
+        kubernetes.io/hostname: {{ .NodeName }}
+{{ if boolVal $.Spec.Secure }}
+      serviceAccountName: {{ $.Spec.ServiceAccountName }}
+{{ end }}
+      containers:
+      - name: cockroachdb
+        image: {{ $.Spec.Image }}:{{ $.Spec.Version }}
+        imagePullPolicy: IfNotPresent
+        ports:
+        - containerPort: 26257
+          name: grpc
+        - containerPort: 8080
+          name: http
+        volumeMounts:
+        - name: datadir
+          mountPath: /cockroach/cockroach-data
+        command:
+          - "/bin/bash"
+          - "-ecx"
+          - |
+            CRARGS=("start" "--logtostderr" "--http-host" "0.0.0.0")
+            CRARGS+=("--locality={{ .Locality }}")
+            CRARGS+=("--advertise-addr={{ .IP }}")
+            CRARGS+=("--join" "{{ $.Spec.TopologyJoinList }}")
+{{ if boolVal $.Spec.Secure }}
+            CRARGS+=("--certs-dir=/cockroach/cockroach-certs")
+{{ else }}
+            CRARGS+=("--insecure")
+{{ end }}
+            exec /cockroach/cockroach ${CRARGS[*]}
+      terminationGracePeriodSeconds: 60
+      volumes:
+      - name: datadir
+        hostPath:
+          path: {{ $.Spec.HostPath }}/{{ .Name }}
+          type: DirectoryOrCreate
+{{ end }}
+`